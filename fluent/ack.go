@@ -0,0 +1,10 @@
+package fluent
+
+//go:generate msgp -tests=false
+
+// AckResp is the acknowledgement Fluentd sends back over the same
+// connection once it has durably received a chunk, when RequestAck is
+// enabled on the sender.
+type AckResp struct {
+	Ack string `msg:"ack"`
+}
@@ -0,0 +1,125 @@
+package fluent
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// fakeAckServer accepts connections and decodes every incoming message --
+// a [tag, time, record] triple, or a [tag, time, record, option] tuple when
+// an option is attached -- sending them to received. If dropFirstAck is
+// set, the first message carrying a "chunk" option never gets an ack frame
+// back, simulating Fluentd never receiving (or the connection dropping)
+// the acknowledgement.
+func fakeAckServer(t *testing.T, ln net.Listener, received chan<- []interface{}, dropFirstAck bool) {
+	var mu sync.Mutex
+	dropped := false
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := msgp.NewReader(bufio.NewReader(conn))
+			for {
+				v, err := r.ReadIntf()
+				if err != nil {
+					return
+				}
+				arr, ok := v.([]interface{})
+				if !ok || (len(arr) != 3 && len(arr) != 4) {
+					continue
+				}
+				received <- arr
+
+				if len(arr) != 4 {
+					continue
+				}
+				opt, hasOpt := arr[3].(map[string]interface{})
+				if !hasOpt {
+					continue
+				}
+				mu.Lock()
+				shouldDrop := dropFirstAck && !dropped
+				if shouldDrop {
+					dropped = true
+				}
+				mu.Unlock()
+				if shouldDrop {
+					continue
+				}
+				chunk, _ := opt["chunk"].(string)
+				w := msgp.NewWriter(conn)
+				w.WriteMapHeader(1)
+				w.WriteString("ack")
+				w.WriteString(chunk)
+				if err := w.Flush(); err != nil {
+					t.Logf("fakeAckServer: failed to flush ack: %s", err)
+				}
+			}
+		}(conn)
+	}
+}
+
+// TestRequestAck_RetryAfterDroppedAck is a regression test for a retry
+// that carried its old chunk option back into the generic buffer: the
+// resend (with chunk="") must not still look like an ack request, or
+// Fluentd's unread ack frame for it desyncs the next readAck on the
+// connection it lands on. RequestAck alone (no SyncPost) also exercises
+// the background sender's ack wait and retry path, since Post itself no
+// longer blocks on it.
+func TestRequestAck_RetryAfterDroppedAck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+	received := make(chan []interface{}, 4)
+	go fakeAckServer(t, ln, received, true)
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	var port int
+	fmt.Sscanf(portStr, "%d", &port)
+
+	f, err := New(Config{
+		FluentHost: host, FluentPort: port,
+		RequestAck: true, Timeout: 300 * time.Millisecond,
+		RetryWait: 50, MaxRetry: 3, ForceStopAsyncSend: true,
+	})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer f.Close()
+
+	// RequestAck alone doesn't make Post synchronous: the ack wait (and
+	// the retry below) happens in the background sender, so Post itself
+	// just buffers and returns.
+	if err := f.Post("app.ack", map[string]string{"k": "v"}); err != nil {
+		t.Fatalf("Post: %s", err)
+	}
+
+	select {
+	case first := <-received:
+		if opt, ok := first[3].(map[string]interface{}); !ok || opt["chunk"] == nil {
+			t.Fatalf("expected the first message to carry a chunk option, got %#v", first[3])
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the first message")
+	}
+
+	select {
+	case retry := <-received:
+		if len(retry) != 3 {
+			t.Fatalf("retried message still carries an option (desync risk): %#v", retry)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the retried message")
+	}
+}
@@ -0,0 +1,190 @@
+package fluent
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// heloMessage carries the options Fluentd sends in its initial HELO
+// message of the shared-key authentication handshake.
+type heloMessage struct {
+	Nonce     []byte
+	Auth      []byte
+	Keepalive bool
+}
+
+// pongMessage carries Fluentd's reply to our PING.
+type pongMessage struct {
+	AuthResult         bool
+	Reason             string
+	ServerHostname     string
+	SharedKeyHexDigest string
+}
+
+// handshake performs the Forward protocol's HELO/PING/PONG shared-key
+// authentication handshake over conn. It is only invoked when
+// Config.SharedKey is set.
+func (f *Fluent) handshake(conn net.Conn) error {
+	r := msgp.NewReader(conn)
+
+	if err := conn.SetReadDeadline(time.Now().Add(f.Config.Timeout)); err != nil {
+		return fmt.Errorf("fluent#handshake: failed to set read deadline: %s", err)
+	}
+	helo, err := readHelo(r)
+	if err != nil {
+		return fmt.Errorf("fluent#handshake: failed to read HELO: %s", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("fluent#handshake: failed to get hostname: %s", err)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("fluent#handshake: failed to generate salt: %s", err)
+	}
+
+	sharedKeyDigest := sha512Hex(salt, []byte(hostname), helo.Nonce, []byte(f.Config.SharedKey))
+	passwordDigest := sha512Hex(helo.Auth, []byte(f.Config.Username), []byte(f.Config.Password))
+
+	if err := conn.SetWriteDeadline(time.Now().Add(f.Config.Timeout)); err != nil {
+		return fmt.Errorf("fluent#handshake: failed to set write deadline: %s", err)
+	}
+	w := msgp.NewWriter(conn)
+	if err := writePing(w, hostname, salt, sharedKeyDigest, f.Config.Username, passwordDigest); err != nil {
+		return fmt.Errorf("fluent#handshake: failed to write PING: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("fluent#handshake: failed to flush PING: %s", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(f.Config.Timeout)); err != nil {
+		return fmt.Errorf("fluent#handshake: failed to set read deadline: %s", err)
+	}
+	pong, err := readPong(r)
+	if err != nil {
+		return fmt.Errorf("fluent#handshake: failed to read PONG: %s", err)
+	}
+	if !pong.AuthResult {
+		return fmt.Errorf("fluent#handshake: server rejected authentication: %s", pong.Reason)
+	}
+
+	expected := sha512Hex(salt, []byte(pong.ServerHostname), helo.Nonce, []byte(f.Config.SharedKey))
+	if pong.SharedKeyHexDigest != expected {
+		return fmt.Errorf("fluent#handshake: shared key digest mismatch")
+	}
+	return nil
+}
+
+func sha512Hex(parts ...[]byte) string {
+	h := sha512.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func readHelo(r *msgp.Reader) (*heloMessage, error) {
+	n, err := r.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n != 2 {
+		return nil, fmt.Errorf("unexpected HELO array length %d", n)
+	}
+	tag, err := r.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	if tag != "HELO" {
+		return nil, fmt.Errorf("unexpected message %q, want HELO", tag)
+	}
+
+	mapLen, err := r.ReadMapHeader()
+	if err != nil {
+		return nil, err
+	}
+	helo := &heloMessage{}
+	for i := uint32(0); i < mapLen; i++ {
+		key, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "nonce":
+			helo.Nonce, err = r.ReadBytes(nil)
+		case "auth":
+			helo.Auth, err = r.ReadBytes(nil)
+		case "keepalive":
+			helo.Keepalive, err = r.ReadBool()
+		default:
+			err = r.Skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return helo, nil
+}
+
+func writePing(w *msgp.Writer, hostname string, salt []byte, sharedKeyHexDigest, username, passwordHexDigest string) error {
+	if err := w.WriteArrayHeader(6); err != nil {
+		return err
+	}
+	if err := w.WriteString("PING"); err != nil {
+		return err
+	}
+	if err := w.WriteString(hostname); err != nil {
+		return err
+	}
+	if err := w.WriteBytes(salt); err != nil {
+		return err
+	}
+	if err := w.WriteString(sharedKeyHexDigest); err != nil {
+		return err
+	}
+	if err := w.WriteString(username); err != nil {
+		return err
+	}
+	return w.WriteString(passwordHexDigest)
+}
+
+func readPong(r *msgp.Reader) (*pongMessage, error) {
+	n, err := r.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n != 5 {
+		return nil, fmt.Errorf("unexpected PONG array length %d", n)
+	}
+	tag, err := r.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	if tag != "PONG" {
+		return nil, fmt.Errorf("unexpected message %q, want PONG", tag)
+	}
+
+	pong := &pongMessage{}
+	if pong.AuthResult, err = r.ReadBool(); err != nil {
+		return nil, err
+	}
+	if pong.Reason, err = r.ReadString(); err != nil {
+		return nil, err
+	}
+	if pong.ServerHostname, err = r.ReadString(); err != nil {
+		return nil, err
+	}
+	if pong.SharedKeyHexDigest, err = r.ReadString(); err != nil {
+		return nil, err
+	}
+	return pong, nil
+}
@@ -0,0 +1,147 @@
+package fluent
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// fakeHandshakeServer plays the Fluentd side of the HELO/PING/PONG
+// exchange for one connection, reporting authResult based on whether the
+// client's digest matches what sharedKey would produce.
+func fakeHandshakeServer(t *testing.T, conn net.Conn, sharedKey string, nonce []byte) {
+	defer conn.Close()
+
+	w := msgp.NewWriter(conn)
+	w.WriteArrayHeader(2)
+	w.WriteString("HELO")
+	w.WriteMapHeader(3)
+	w.WriteString("nonce")
+	w.WriteBytes(nonce)
+	w.WriteString("auth")
+	w.WriteBytes(nil)
+	w.WriteString("keepalive")
+	w.WriteBool(false)
+	if err := w.Flush(); err != nil {
+		t.Logf("fakeHandshakeServer: failed to flush HELO: %s", err)
+		return
+	}
+
+	r := msgp.NewReader(bufio.NewReader(conn))
+	n, err := r.ReadArrayHeader()
+	if err != nil || n != 6 {
+		t.Logf("fakeHandshakeServer: bad PING array header: n=%d err=%v", n, err)
+		return
+	}
+	if _, err := r.ReadString(); err != nil { // "PING"
+		return
+	}
+	hostname, err := r.ReadString()
+	if err != nil {
+		return
+	}
+	salt, err := r.ReadBytes(nil)
+	if err != nil {
+		return
+	}
+	sharedKeyDigest, err := r.ReadString()
+	if err != nil {
+		return
+	}
+	if _, err := r.ReadString(); err != nil { // username
+		return
+	}
+	if _, err := r.ReadString(); err != nil { // passwordDigest
+		return
+	}
+
+	serverHostname := "fake-fluentd"
+	expected := sha512Hex(salt, []byte(hostname), nonce, []byte(sharedKey))
+	authResult := sharedKeyDigest == expected
+
+	w2 := msgp.NewWriter(conn)
+	w2.WriteArrayHeader(5)
+	w2.WriteString("PONG")
+	w2.WriteBool(authResult)
+	w2.WriteString("")
+	w2.WriteString(serverHostname)
+	w2.WriteString(sha512Hex(salt, []byte(serverHostname), nonce, []byte(sharedKey)))
+	if err := w2.Flush(); err != nil {
+		t.Logf("fakeHandshakeServer: failed to flush PONG: %s", err)
+	}
+}
+
+func listenAndDial(t *testing.T) (ln net.Listener, host string, port int) {
+	var err error
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	var portStr string
+	host, portStr, _ = net.SplitHostPort(ln.Addr().String())
+	fmt.Sscanf(portStr, "%d", &port)
+	return
+}
+
+func TestHandshake_Success(t *testing.T) {
+	ln, host, port := listenAndDial(t)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		fakeHandshakeServer(t, conn, "secret", []byte("0123456789abcdef"))
+	}()
+
+	f, err := New(Config{FluentHost: host, FluentPort: port, SharedKey: "secret"})
+	if err != nil {
+		t.Fatalf("New: expected handshake to succeed, got: %s", err)
+	}
+	defer f.Close()
+}
+
+func TestHandshake_RejectedOnMismatchedSharedKey(t *testing.T) {
+	ln, host, port := listenAndDial(t)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		fakeHandshakeServer(t, conn, "server-side-key", []byte("0123456789abcdef"))
+	}()
+
+	_, err := New(Config{FluentHost: host, FluentPort: port, SharedKey: "client-side-key"})
+	if err == nil {
+		t.Fatal("expected New to fail when shared keys don't match")
+	}
+}
+
+func TestHandshake_RespectsTimeout(t *testing.T) {
+	ln, host, port := listenAndDial(t)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Stall: never send HELO.
+		time.Sleep(10 * time.Second)
+	}()
+
+	start := time.Now()
+	_, err := New(Config{FluentHost: host, FluentPort: port, SharedKey: "secret", Timeout: 200 * time.Millisecond})
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("expected New to fail against a stalled handshake peer")
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("handshake took %s, expected it to respect Config.Timeout", elapsed)
+	}
+}
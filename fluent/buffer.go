@@ -0,0 +1,270 @@
+package fluent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errBufferFull is returned by Push when BufferOverflowAction is
+// BufferOverflowDropNewest (the default) and BufferTotalLimit has been
+// reached.
+var errBufferFull = errors.New("fluent#Buffer: buffer is full")
+
+// Buffer decouples the spooler/sender from how pending, not-yet-delivered
+// payloads are stored, so an in-memory queue and a disk-backed one can be
+// used interchangeably. Implementations must be safe for concurrent use.
+type Buffer interface {
+	// Push enqueues an already msgpack-encoded payload, returning an
+	// opaque id for it. It enforces BufferLimit (per chunk) and
+	// BufferTotalLimit (across all pending chunks), applying
+	// BufferOverflowAction when the latter is exceeded.
+	Push(data []byte) (id string, err error)
+	// Pop removes and returns the oldest pending payload, if any.
+	Pop() (id string, data []byte, ok bool)
+	// Ack durably removes a payload that was sent (and acknowledged,
+	// when RequestAck is enabled) successfully.
+	Ack(id string) error
+	// Requeue puts a popped-but-undelivered payload back so a later Pop
+	// can retry it.
+	Requeue(id string, data []byte)
+	// Len reports the number of currently pending payloads.
+	Len() int
+}
+
+// newBuffer returns a memoryBuffer, or a fileBuffer rooted at
+// Config.BufferPath when one is configured. done is closed when the
+// owning Fluent is shutting down, so a Push blocked under
+// BufferOverflowBlock can give up instead of blocking forever.
+func newBuffer(cfg Config, done <-chan struct{}) (Buffer, error) {
+	if cfg.BufferPath != "" {
+		return newFileBuffer(cfg.BufferPath, cfg.BufferLimit, cfg.BufferTotalLimit, cfg.BufferOverflowAction, done)
+	}
+	return newMemoryBuffer(cfg.BufferLimit, cfg.BufferTotalLimit, cfg.BufferOverflowAction, done), nil
+}
+
+// memoryBuffer is the default Buffer: a ring of in-memory chunks that
+// does not survive a process restart.
+type memoryBuffer struct {
+	mu         sync.Mutex
+	chunkLimit int
+	totalLimit int
+	overflow   string
+	seq        uint64
+	order      []string
+	items      map[string][]byte
+	size       int
+	done       <-chan struct{}
+}
+
+func newMemoryBuffer(chunkLimit, totalLimit int, overflow string, done <-chan struct{}) *memoryBuffer {
+	return &memoryBuffer{
+		chunkLimit: chunkLimit,
+		totalLimit: totalLimit,
+		overflow:   overflow,
+		items:      make(map[string][]byte),
+		done:       done,
+	}
+}
+
+func (b *memoryBuffer) Push(data []byte) (string, error) {
+	if b.chunkLimit > 0 && len(data) > b.chunkLimit {
+		return "", fmt.Errorf("fluent#Buffer: chunk of %d bytes exceeds BufferLimit of %d", len(data), b.chunkLimit)
+	}
+
+	b.mu.Lock()
+	for b.totalLimit > 0 && b.size+len(data) > b.totalLimit && len(b.order) > 0 {
+		switch b.overflow {
+		case BufferOverflowDropOldest:
+			oldest := b.order[0]
+			b.order = b.order[1:]
+			b.size -= len(b.items[oldest])
+			delete(b.items, oldest)
+		case BufferOverflowBlock:
+			b.mu.Unlock()
+			select {
+			case <-time.After(blockPollInterval):
+			case <-b.done:
+				return "", ErrClosed
+			}
+			b.mu.Lock()
+		default: // BufferOverflowDropNewest
+			b.mu.Unlock()
+			return "", errBufferFull
+		}
+	}
+
+	b.seq++
+	id := strconv.FormatUint(b.seq, 10)
+	b.items[id] = data
+	b.order = append(b.order, id)
+	b.size += len(data)
+	b.mu.Unlock()
+	return id, nil
+}
+
+func (b *memoryBuffer) Pop() (string, []byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.order) == 0 {
+		return "", nil, false
+	}
+	id := b.order[0]
+	b.order = b.order[1:]
+	data := b.items[id]
+	delete(b.items, id)
+	b.size -= len(data)
+	return id, data, true
+}
+
+// Ack is a no-op: Pop already removed the payload. It exists so
+// memoryBuffer satisfies Buffer alongside fileBuffer, which must delete
+// its backing chunk file here.
+func (b *memoryBuffer) Ack(id string) error {
+	return nil
+}
+
+func (b *memoryBuffer) Requeue(id string, data []byte) {
+	b.mu.Lock()
+	b.items[id] = data
+	b.order = append([]string{id}, b.order...)
+	b.size += len(data)
+	b.mu.Unlock()
+}
+
+func (b *memoryBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.order)
+}
+
+// fileBuffer is a Buffer backed by a directory of chunk files, one per
+// pending payload, similar to Fluentd's own file buffer plugin: as long
+// as BufferPath points at the same directory across restarts, payloads
+// that were pushed but never acked are picked up again.
+type fileBuffer struct {
+	mu         sync.Mutex
+	dir        string
+	chunkLimit int
+	totalLimit int
+	overflow   string
+	seq        uint64
+	size       int
+	order      []string
+	done       <-chan struct{}
+}
+
+func newFileBuffer(dir string, chunkLimit, totalLimit int, overflow string, done <-chan struct{}) (*fileBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fluent#FileBuffer: failed to create %s: %s", dir, err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("fluent#FileBuffer: failed to read %s: %s", dir, err)
+	}
+
+	fb := &fileBuffer{dir: dir, chunkLimit: chunkLimit, totalLimit: totalLimit, overflow: overflow, done: done}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+		fb.size += int(entry.Size())
+	}
+	sort.Strings(names)
+	fb.order = names
+	return fb, nil
+}
+
+func (fb *fileBuffer) Push(data []byte) (string, error) {
+	if fb.chunkLimit > 0 && len(data) > fb.chunkLimit {
+		return "", fmt.Errorf("fluent#Buffer: chunk of %d bytes exceeds BufferLimit of %d", len(data), fb.chunkLimit)
+	}
+
+	fb.mu.Lock()
+	for fb.totalLimit > 0 && fb.size+len(data) > fb.totalLimit && len(fb.order) > 0 {
+		switch fb.overflow {
+		case BufferOverflowDropOldest:
+			oldest := fb.order[0]
+			fb.order = fb.order[1:]
+			fb.removeLocked(oldest)
+		case BufferOverflowBlock:
+			fb.mu.Unlock()
+			select {
+			case <-time.After(blockPollInterval):
+			case <-fb.done:
+				return "", ErrClosed
+			}
+			fb.mu.Lock()
+		default: // BufferOverflowDropNewest
+			fb.mu.Unlock()
+			return "", errBufferFull
+		}
+	}
+
+	fb.seq++
+	id := fmt.Sprintf("%020d-%016x.chunk", time.Now().UnixNano(), fb.seq)
+	if err := ioutil.WriteFile(filepath.Join(fb.dir, id), data, 0600); err != nil {
+		fb.mu.Unlock()
+		return "", fmt.Errorf("fluent#FileBuffer: failed to write chunk: %s", err)
+	}
+	fb.order = append(fb.order, id)
+	fb.size += len(data)
+	fb.mu.Unlock()
+	return id, nil
+}
+
+func (fb *fileBuffer) Pop() (string, []byte, bool) {
+	fb.mu.Lock()
+	if len(fb.order) == 0 {
+		fb.mu.Unlock()
+		return "", nil, false
+	}
+	id := fb.order[0]
+	fb.order = fb.order[1:]
+	fb.mu.Unlock()
+
+	data, err := ioutil.ReadFile(filepath.Join(fb.dir, id))
+	if err != nil {
+		// The chunk vanished from under us (e.g. removed out of band);
+		// it's already gone from fb.order, so just move on.
+		return "", nil, false
+	}
+	return id, data, true
+}
+
+func (fb *fileBuffer) Ack(id string) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.removeLocked(id)
+}
+
+func (fb *fileBuffer) removeLocked(id string) error {
+	path := filepath.Join(fb.dir, id)
+	if info, err := os.Stat(path); err == nil {
+		fb.size -= int(info.Size())
+	}
+	return os.Remove(path)
+}
+
+// Requeue puts id back at the front of the pending order. The chunk file
+// itself was never deleted by Pop, so there is nothing to restore.
+func (fb *fileBuffer) Requeue(id string, data []byte) {
+	fb.mu.Lock()
+	fb.order = append([]string{id}, fb.order...)
+	fb.mu.Unlock()
+}
+
+func (fb *fileBuffer) Len() int {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return len(fb.order)
+}
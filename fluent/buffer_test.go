@@ -0,0 +1,85 @@
+package fluent
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestFileBuffer_SurvivesRestart checks that payloads pushed but never
+// acked are picked back up by a fresh fileBuffer rooted at the same
+// directory, simulating a process restart after a crash.
+func TestFileBuffer_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	fb, err := newFileBuffer(dir, 0, 0, BufferOverflowDropNewest, nil)
+	if err != nil {
+		t.Fatalf("newFileBuffer: %s", err)
+	}
+	if _, err := fb.Push([]byte("payload-1")); err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if _, err := fb.Push([]byte("payload-2")); err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	id, data, ok := fb.Pop()
+	if !ok {
+		t.Fatal("expected a pending payload")
+	}
+	if err := fb.Ack(id); err != nil {
+		t.Fatalf("Ack: %s", err)
+	}
+	_ = data // payload-1 acked and gone; payload-2 stays pending, simulating a crash before it was sent
+
+	// "Restart": open a brand new fileBuffer over the same directory.
+	restarted, err := newFileBuffer(dir, 0, 0, BufferOverflowDropNewest, nil)
+	if err != nil {
+		t.Fatalf("newFileBuffer (restart): %s", err)
+	}
+	if got := restarted.Len(); got != 1 {
+		t.Fatalf("Len() after restart = %d, want 1 (only the unacked payload should survive)", got)
+	}
+	_, data, ok = restarted.Pop()
+	if !ok {
+		t.Fatal("expected the unacked payload to still be pending after restart")
+	}
+	if string(data) != "payload-2" {
+		t.Errorf("recovered payload = %q, want %q", data, "payload-2")
+	}
+}
+
+// TestSender_DoesNotStormReconnects is a regression test: with a single
+// buffered payload and a refused connection, the sender loop must not
+// spawn an unbounded number of reconnect goroutines.
+func TestSender_DoesNotStormReconnects(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	f, err := New(Config{
+		FluentHost: "127.0.0.1", FluentPort: 1, // nothing listens here
+		AsyncConnect:       true,
+		ForceStopAsyncSend: true,
+		RetryWait:          10,
+		MaxRetry:           50,
+	})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		_ = f.Post("never.delivered", map[string]string{"i": fmt.Sprint(i)})
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if after := runtime.NumGoroutine(); after-before > 20 {
+		t.Errorf("goroutine count grew by %d while disconnected, want a bounded reconnect loop", after-before)
+	}
+
+	closeDone := make(chan struct{})
+	go func() { f.Close(); close(closeDone) }()
+	select {
+	case <-closeDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return in time")
+	}
+}
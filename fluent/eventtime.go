@@ -0,0 +1,47 @@
+package fluent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// eventTimeExt is the msgpack extension type code Fluentd uses for its
+// EventTime, as defined by the Forward protocol spec.
+const eventTimeExt = 0x0
+
+// EventTime represents Fluentd's EventTime extension type, which extends
+// the plain Unix timestamp with nanosecond precision. It implements
+// msgp.Extension so it can be embedded in Message.Time.
+type EventTime time.Time
+
+// ExtensionType implements msgp.Extension.
+func (tm *EventTime) ExtensionType() int8 {
+	return eventTimeExt
+}
+
+// Len implements msgp.Extension.
+func (tm *EventTime) Len() int {
+	return 8
+}
+
+// MarshalBinaryTo implements msgp.Extension. It writes 4 bytes of
+// big-endian seconds since the epoch followed by 4 bytes of big-endian
+// nanoseconds, per the Forward protocol's EventTime format.
+func (tm *EventTime) MarshalBinaryTo(b []byte) error {
+	t := time.Time(*tm)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return nil
+}
+
+// UnmarshalBinary implements msgp.Extension.
+func (tm *EventTime) UnmarshalBinary(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("fluent#EventTime: invalid data length %d, expected 8", len(b))
+	}
+	sec := binary.BigEndian.Uint32(b)
+	nsec := binary.BigEndian.Uint32(b[4:])
+	*tm = EventTime(time.Unix(int64(sec), int64(nsec)))
+	return nil
+}
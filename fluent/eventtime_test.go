@@ -0,0 +1,125 @@
+package fluent
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestEventTime_MarshalUnmarshalBinary(t *testing.T) {
+	want := time.Unix(1609459200, 123456789)
+	et := EventTime(want)
+
+	buf := make([]byte, et.Len())
+	if err := et.MarshalBinaryTo(buf); err != nil {
+		t.Fatalf("MarshalBinaryTo: %s", err)
+	}
+
+	var got EventTime
+	if err := got.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("UnmarshalBinary: %s", err)
+	}
+	gotTime := time.Time(got)
+	if gotTime.Unix() != want.Unix() || gotTime.Nanosecond() != want.Nanosecond() {
+		t.Errorf("round trip mismatch: got %v, want %v", gotTime, want)
+	}
+}
+
+func TestEventTime_UnmarshalBinary_InvalidLength(t *testing.T) {
+	var et EventTime
+	if err := et.UnmarshalBinary([]byte{1, 2, 3}); err == nil {
+		t.Error("expected an error for a truncated extension payload, got nil")
+	}
+}
+
+func TestEventTime_ExtensionType(t *testing.T) {
+	var et EventTime
+	if got := et.ExtensionType(); got != eventTimeExt {
+		t.Errorf("ExtensionType() = %d, want %d", got, eventTimeExt)
+	}
+	if got := et.Len(); got != 8 {
+		t.Errorf("Len() = %d, want 8", got)
+	}
+}
+
+// TestSubSecondPrecision_RoundTripsOverTheWire posts with
+// SubSecondPrecision against a fake Forward receiver and checks that the
+// time value on the wire is the EventTime extension, not a plain Unix
+// second timestamp, and that its nanoseconds survive the trip.
+func TestSubSecondPrecision_RoundTripsOverTheWire(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+
+	type decoded struct {
+		ext *msgp.RawExtension
+		err error
+	}
+	results := make(chan decoded, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			results <- decoded{err: err}
+			return
+		}
+		defer conn.Close()
+		r := msgp.NewReader(bufio.NewReader(conn))
+		if _, err := r.ReadArrayHeader(); err != nil {
+			results <- decoded{err: err}
+			return
+		}
+		if _, err := r.ReadString(); err != nil { // tag
+			results <- decoded{err: err}
+			return
+		}
+		ext := &msgp.RawExtension{}
+		if err := r.ReadExtension(ext); err != nil {
+			results <- decoded{err: err}
+			return
+		}
+		results <- decoded{ext: ext}
+	}()
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	var port int
+	if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
+		t.Fatalf("parse port: %s", err)
+	}
+
+	f, err := New(Config{FluentHost: host, FluentPort: port, SubSecondPrecision: true})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer f.Close()
+
+	tm := time.Unix(1700000000, 987000000)
+	if err := f.PostWithTime("app.time", tm, map[string]string{"k": "v"}); err != nil {
+		t.Fatalf("PostWithTime: %s", err)
+	}
+
+	select {
+	case got := <-results:
+		if got.err != nil {
+			t.Fatalf("receiver: %s", got.err)
+		}
+		if got.ext.Type != eventTimeExt {
+			t.Fatalf("extension type = %d, want %d (plain ints aren't ext-typed)", got.ext.Type, eventTimeExt)
+		}
+		var et EventTime
+		if err := et.UnmarshalBinary(got.ext.Data); err != nil {
+			t.Fatalf("UnmarshalBinary: %s", err)
+		}
+		gotTime := time.Time(et)
+		if gotTime.Unix() != tm.Unix() || gotTime.Nanosecond() != tm.Nanosecond() {
+			t.Errorf("time on the wire = %v, want %v", gotTime, tm)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the message to arrive")
+	}
+}
@@ -1,15 +1,19 @@
 package fluent
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
 	"math"
 	"net"
 	"reflect"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/tinylib/msgp/msgp"
 	"golang.org/x/net/context"
 )
 
@@ -20,12 +24,28 @@ const (
 	defaultPort                   = 24224
 	defaultTimeout                = 3 * time.Second
 	defaultBufferLimit            = 8 * 1024 * 1024
+	defaultBufferTotalLimit       = 32 * 1024 * 1024
 	defaultRetryWait              = 500
 	defaultMaxRetry               = 13
 	defaultReconnectWaitIncreRate = 1.5
 	defaultSyncPost               = false
+
+	blockPollInterval  = 100 * time.Millisecond
+	senderPollInterval = 50 * time.Millisecond
+)
+
+// BufferOverflowAction values control what a Buffer does with a newly
+// pushed chunk once BufferTotalLimit has been reached.
+const (
+	BufferOverflowDropNewest = "drop_newest"
+	BufferOverflowDropOldest = "drop_oldest"
+	BufferOverflowBlock      = "block"
 )
 
+// ErrClosed is returned by Post and friends once the logger has been
+// closed, instead of sending on a channel nothing is reading from anymore.
+var ErrClosed = errors.New("fluent#Post: logger has been closed")
+
 type Config struct {
 	FluentPort       int
 	FluentHost       string
@@ -37,15 +57,72 @@ type Config struct {
 	MaxRetry         int
 	TagPrefix        string
 	SyncPost         bool
+
+	// SubSecondPrecision, when true, serializes the record time as a
+	// Fluentd EventTime (msgpack ext type 0x00) instead of a plain Unix
+	// second timestamp, preserving nanosecond precision.
+	SubSecondPrecision bool
+
+	// RequestAck, when true, asks Fluentd to acknowledge each chunk it
+	// receives and requeues it for retry if the acknowledgement never
+	// arrives, so delivery is at-least-once instead of fire-and-forget.
+	// The ack wait itself happens in the background sender, so Post stays
+	// non-blocking; combine with SyncPost to also wait for the ack
+	// synchronously from Post.
+	RequestAck bool
+
+	// AsyncConnect, when true, makes New return immediately instead of
+	// dialing synchronously; the initial connection attempt (and any
+	// retries) happen in the background while posts are buffered.
+	AsyncConnect bool
+
+	// BufferOverflowAction controls how the Buffer handles a post once
+	// BufferTotalLimit is reached. One of BufferOverflowDropNewest
+	// (default), BufferOverflowDropOldest, or BufferOverflowBlock.
+	BufferOverflowAction string
+
+	// BufferTotalLimit caps the combined size in bytes of all pending,
+	// not-yet-delivered chunks, as opposed to BufferLimit which caps the
+	// size of a single chunk.
+	BufferTotalLimit int
+
+	// BufferPath, when set, makes the logger use a fileBuffer rooted at
+	// this directory instead of the default in-memory buffer, so pending
+	// chunks survive a process restart.
+	BufferPath string
+
+	// ForceStopAsyncSend, when true, makes Close abort any in-flight
+	// reconnect loop immediately instead of letting it run out its
+	// retries, so callers that must shut down promptly (even against an
+	// unreachable upstream) aren't held up.
+	ForceStopAsyncSend bool
+
+	// TLSConfig is used to dial when FluentNetwork is "tls".
+	TLSConfig *tls.Config
+
+	// SharedKey, when set, makes connect perform the Forward protocol's
+	// HELO/PING/PONG shared-key authentication handshake right after
+	// dialing. The PING always carries Username and a digest of the
+	// HELO's auth salt, Username and Password, empty or not.
+	SharedKey string
+	Username  string
+	Password  string
 }
 
 type Fluent struct {
 	Config
-	conn   io.WriteCloser
-	buf    []byte
-	postCh chan []byte
-	ctx    context.Context
-	cancel context.CancelFunc
+	mu           sync.RWMutex
+	sendMu       sync.Mutex
+	wg           sync.WaitGroup
+	conn         net.Conn
+	buffer       Buffer
+	postCh       chan []byte
+	ctx          context.Context
+	cancel       context.CancelFunc
+	errs         chan error
+	forceStop    chan struct{}
+	closed       bool
+	reconnecting bool
 }
 
 // New creates a new Logger.
@@ -68,6 +145,9 @@ func New(config Config) (f *Fluent, err error) {
 	if config.BufferLimit == 0 {
 		config.BufferLimit = defaultBufferLimit
 	}
+	if config.BufferTotalLimit == 0 {
+		config.BufferTotalLimit = defaultBufferTotalLimit
+	}
 	if config.RetryWait == 0 {
 		config.RetryWait = defaultRetryWait
 	}
@@ -77,49 +157,84 @@ func New(config Config) (f *Fluent, err error) {
 	if config.SyncPost == false {
 		config.SyncPost = defaultSyncPost
 	}
-	f = &Fluent{
-		Config: config,
-		postCh: make(chan []byte),
+	ctx, cancel := context.WithCancel(context.Background())
+	buffer, err := newBuffer(config, ctx.Done())
+	if err != nil {
+		cancel()
+		return
 	}
 
-	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f = &Fluent{
+		Config:    config,
+		buffer:    buffer,
+		postCh:    make(chan []byte),
+		errs:      make(chan error, 1),
+		forceStop: make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
 
-	if err = f.connect(); err != nil {
+	if config.AsyncConnect {
+		f.reconnect()
+	} else if err = f.connect(); err != nil {
 		return
 	}
-	go f.spooler(f.ctx)
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.spooler(f.ctx)
+	}()
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.sender(f.ctx)
+	}()
 
 	return
 }
 
+// Errors returns a channel of background errors, such as a connection
+// that permanently failed to reconnect after MaxRetry retries. Sends on
+// it are non-blocking, so a slow or absent reader only drops the error
+// rather than stalling the logger; callers that care should drain it.
+func (f *Fluent) Errors() <-chan error {
+	return f.errs
+}
+
+func (f *Fluent) notifyError(err error) {
+	select {
+	case f.errs <- err:
+	default:
+	}
+}
+
 // Post writes the output for a logging event.
 //
 // Examples:
 //
-//  // send string
-//  f.Post("tag_name", "data")
-//
-//  // send map[string]
-//  mapStringData := map[string]string{
-//  	"foo":  "bar",
-//  }
-//  f.Post("tag_name", mapStringData)
+//	// send string
+//	f.Post("tag_name", "data")
 //
-//  // send message with specified time
-//  mapStringData := map[string]string{
-//  	"foo":  "bar",
-//  }
-//  tm := time.Now()
-//  f.PostWithTime("tag_name", tm, mapStringData)
+//	// send map[string]
+//	mapStringData := map[string]string{
+//		"foo":  "bar",
+//	}
+//	f.Post("tag_name", mapStringData)
 //
-//  // send struct
-//  structData := struct {
-//  		Name string `msg:"name"`
-//  } {
-//  		"john smith",
-//  }
-//  f.Post("tag_name", structData)
+//	// send message with specified time
+//	mapStringData := map[string]string{
+//		"foo":  "bar",
+//	}
+//	tm := time.Now()
+//	f.PostWithTime("tag_name", tm, mapStringData)
 //
+//	// send struct
+//	structData := struct {
+//			Name string `msg:"name"`
+//	} {
+//			"john smith",
+//	}
+//	f.Post("tag_name", structData)
 func (f *Fluent) Post(tag string, message interface{}) error {
 	timeNow := time.Now()
 	return f.PostWithTime(tag, timeNow, message)
@@ -165,57 +280,197 @@ func (f *Fluent) PostWithTime(tag string, tm time.Time, message interface{}) err
 }
 
 func (f *Fluent) EncodeAndPostData(tag string, tm time.Time, message interface{}) error {
-	data, dumperr := f.EncodeData(tag, tm, message)
+	data, chunk, dumperr := f.encodeData(tag, tm, message)
 	if dumperr != nil {
 		return fmt.Errorf("fluent#EncodeAndPostData: can't convert '%s' to msgpack:%s", message, dumperr)
 		// fmt.Println("fluent#Post: can't convert to msgpack:", message, dumperr)
 	}
 	if f.SyncPost {
-		return f.send(data)
+		// SyncPost has to honor Close the same way PostRawData does, or a
+		// post racing Close would see a confusing "no connection" error
+		// instead of ErrClosed and trigger a needless reconnect attempt.
+		// RequestAck alone doesn't take this path: its ack wait happens in
+		// the background sender instead, so Post stays non-blocking.
+		f.mu.RLock()
+		closed := f.closed
+		f.mu.RUnlock()
+		if closed {
+			return ErrClosed
+		}
+		return f.send(data, chunk)
 	}
-	f.PostRawData(data)
-	return nil
+	return f.PostRawData(data)
+}
+
+// PostRawData posts a pre-encoded msgpack payload, bypassing EncodeData.
+// It returns ErrClosed if the logger has already been closed.
+func (f *Fluent) PostRawData(data []byte) error {
+	return f.postRawData(data)
 }
 
-func (f *Fluent) PostRawData(data []byte) {
-	var buf []byte
-	copy(buf, f.buf)
-	f.postCh <- buf
+func (f *Fluent) postRawData(data []byte) error {
+	f.mu.RLock()
+	closed := f.closed
+	f.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	select {
+	case f.postCh <- buf:
+		return nil
+	case <-f.ctx.Done():
+		return ErrClosed
+	}
 }
 
 func (f *Fluent) EncodeData(tag string, tm time.Time, message interface{}) (data []byte, err error) {
-	timeUnix := tm.Unix()
-	msg := &Message{Tag: tag, Time: timeUnix, Record: message}
+	data, _, err = f.encodeData(tag, tm, message)
+	return
+}
+
+// encodeData is like EncodeData but also returns the chunk id embedded in
+// the message's option map when RequestAck is enabled, so the caller can
+// match it against Fluentd's acknowledgement.
+func (f *Fluent) encodeData(tag string, tm time.Time, message interface{}) (data []byte, chunk string, err error) {
+	var option interface{}
+	if f.Config.RequestAck {
+		chunk, err = generateChunkID()
+		if err != nil {
+			return
+		}
+		option = map[string]string{"chunk": chunk}
+	}
+
+	var msg *Message
+	if f.Config.SubSecondPrecision {
+		eventTime := EventTime(tm)
+		msg = &Message{Tag: tag, Time: &eventTime, Record: message, Option: option}
+	} else {
+		msg = &Message{Tag: tag, Time: tm.Unix(), Record: message, Option: option}
+	}
 	data, err = msg.MarshalMsg(nil)
 	return
 }
 
-// Close closes the connection.
+// generateChunkID returns a base64-encoded random id to use as the
+// Forward-protocol "chunk" option when requesting an acknowledgement.
+func generateChunkID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Close shuts the logger down: it stops accepting new posts, flushes what
+// it can to the connection, and waits for the spooler, sender and any
+// in-flight reconnect loop to exit before returning. If
+// ForceStopAsyncSend is set, a reconnect loop currently retrying against
+// an unreachable upstream is aborted immediately instead of being waited
+// out.
 func (f *Fluent) Close() (err error) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	if f.Config.ForceStopAsyncSend {
+		close(f.forceStop)
+	}
 	f.cancel()
+	f.wg.Wait()
+	f.drainBuffer()
+	f.close()
 	return nil
 }
 
+// drainBuffer makes a best-effort attempt to deliver whatever is still
+// pending in the buffer before Close returns. It gives up at the first
+// error, leaving the rest for the next process to pick up (fileBuffer) or
+// dropping it (the default in-memory buffer).
+func (f *Fluent) drainBuffer() {
+	for {
+		id, data, ok := f.buffer.Pop()
+		if !ok {
+			return
+		}
+		var chunk string
+		if f.Config.RequestAck {
+			var chunkErr error
+			chunk, chunkErr = extractChunk(data)
+			if chunkErr != nil {
+				f.notifyError(fmt.Errorf("fluent#Close: failed to read chunk option: %s", chunkErr))
+			}
+		}
+		if err := f.send(data, chunk); err != nil {
+			f.notifyError(fmt.Errorf("fluent#Close: failed to flush buffered payload: %s", err))
+			// An ack-wait failure that did manage to re-enqueue a
+			// stripped retry has already left a copy behind for the
+			// next process/sender to find, so the original is safe to
+			// ack away here too; anything else just stops the drain,
+			// leaving the original as the only copy (picked up by the
+			// next process for FileBuffer, lost for memoryBuffer).
+			var ackErr *ackWaitError
+			if errors.As(err, &ackErr) && ackErr.recovered {
+				if ackErr2 := f.buffer.Ack(id); ackErr2 != nil {
+					f.notifyError(fmt.Errorf("fluent#Close: failed to ack superseded payload: %s", ackErr2))
+				}
+			}
+			return
+		}
+		if err := f.buffer.Ack(id); err != nil {
+			f.notifyError(fmt.Errorf("fluent#Close: failed to ack flushed payload: %s", err))
+		}
+	}
+}
+
 // close closes the connection.
 func (f *Fluent) close() (err error) {
-	if f.conn == nil {
+	f.mu.Lock()
+	conn := f.conn
+	f.conn = nil
+	f.mu.Unlock()
+	if conn == nil {
 		return
 	}
-	f.conn.Close()
-	f.conn = nil
-	return
+	return conn.Close()
 }
 
 // connect establishes a new connection using the specified transport.
 func (f *Fluent) connect() (err error) {
+	var conn net.Conn
 	switch f.Config.FluentNetwork {
 	case "tcp":
-		f.conn, err = net.DialTimeout(f.Config.FluentNetwork, f.Config.FluentHost+":"+strconv.Itoa(f.Config.FluentPort), f.Config.Timeout)
+		conn, err = net.DialTimeout(f.Config.FluentNetwork, f.Config.FluentHost+":"+strconv.Itoa(f.Config.FluentPort), f.Config.Timeout)
 	case "unix":
-		f.conn, err = net.DialTimeout(f.Config.FluentNetwork, f.Config.FluentSocketPath, f.Config.Timeout)
+		conn, err = net.DialTimeout(f.Config.FluentNetwork, f.Config.FluentSocketPath, f.Config.Timeout)
+	case "tls":
+		dialer := &net.Dialer{Timeout: f.Config.Timeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", f.Config.FluentHost+":"+strconv.Itoa(f.Config.FluentPort), f.Config.TLSConfig)
 	default:
 		err = net.UnknownNetworkError(f.Config.FluentNetwork)
 	}
+	if err != nil {
+		return
+	}
+
+	if f.Config.SharedKey != "" {
+		if err = f.handshake(conn); err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	f.mu.Lock()
+	f.conn = conn
+	f.mu.Unlock()
 	return
 }
 
@@ -223,72 +478,221 @@ func e(x, y float64) int {
 	return int(math.Pow(x, y))
 }
 
+// reconnect starts a reconnect loop in the background, unless one is
+// already in flight or Close has been called: without this guard, every failed send() call onto a
+// dead connection would spawn its own retry loop, and a sender() spinning
+// against a refused connection can call send() thousands of times a
+// second, so this dedupe is what keeps the goroutine count bounded.
 func (f *Fluent) reconnect() {
+	f.mu.Lock()
+	if f.reconnecting || f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.reconnecting = true
+	f.mu.Unlock()
+
+	f.wg.Add(1)
 	go func() {
+		defer f.wg.Done()
+		defer func() {
+			f.mu.Lock()
+			f.reconnecting = false
+			f.mu.Unlock()
+		}()
 		for i := 0; ; i++ {
+			select {
+			case <-f.forceStop:
+				return
+			default:
+			}
 			err := f.connect()
 			if err == nil {
-				break
+				return
 			}
 			if i == f.Config.MaxRetry {
-				panic("fluent#reconnect: failed to reconnect!")
+				f.notifyError(fmt.Errorf("fluent#reconnect: failed to reconnect after %d retries: %s", f.Config.MaxRetry, err))
+				return
 			}
 			waitTime := f.Config.RetryWait * e(defaultReconnectWaitIncreRate, float64(i-1))
-			time.Sleep(time.Duration(waitTime) * time.Millisecond)
+			select {
+			case <-time.After(time.Duration(waitTime) * time.Millisecond):
+			case <-f.forceStop:
+				return
+			}
 		}
 	}()
 }
 
-func (f *Fluent) flushBuffer() {
-	f.buf = f.buf[0:0]
+// ackWaitError wraps the error from a failed readAck, distinguishing it
+// from other send failures. recovered reports whether send actually
+// managed to re-enqueue a stripped retry for it: only then should a
+// caller like sender Ack the original instead of requeuing it -- if the
+// re-enqueue itself failed (e.g. racing Close), the original is the only
+// copy left and must still be requeued to avoid losing it outright.
+type ackWaitError struct {
+	err       error
+	recovered bool
 }
 
-func (f *Fluent) send(data []byte) (err error) {
-	if f.conn == nil {
+func (e *ackWaitError) Error() string { return e.err.Error() }
+func (e *ackWaitError) Unwrap() error { return e.err }
+
+// send writes data to the current connection and, if chunk is set, waits
+// for its ack. It holds sendMu for the whole write-then-ack-wait so that
+// concurrent callers (direct SyncPost/RequestAck posts racing the
+// background sender) can't interleave reads on the same conn and steal
+// each other's ack frames.
+func (f *Fluent) send(data []byte, chunk string) (err error) {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+
+	f.mu.RLock()
+	conn := f.conn
+	f.mu.RUnlock()
+	if conn == nil {
+		f.reconnect()
+		return errors.New("fluent#send: no connection available, reconnecting")
+	}
+	_, err = conn.Write(data)
+	if err != nil {
+		f.dropConn(conn)
 		f.reconnect()
+		return
+	}
+	if chunk != "" {
+		if ackErr := f.readAck(conn, chunk); ackErr != nil {
+			// We can't be sure Fluentd durably received the chunk. The
+			// retry goes through the generic (non-ack) buffer, so the
+			// chunk option has to come out of the payload first --
+			// otherwise Fluentd still writes an ack frame for it that
+			// nobody ever reads, desyncing the next readAck on whichever
+			// connection the retry eventually lands on.
+			recovered := false
+			if retryData, stripErr := stripOption(data); stripErr == nil {
+				if postErr := f.postRawData(retryData); postErr != nil {
+					f.notifyError(fmt.Errorf("fluent#send: failed to re-enqueue stripped retry: %s", postErr))
+				} else {
+					recovered = true
+				}
+			} else {
+				f.notifyError(fmt.Errorf("fluent#send: failed to strip chunk option for retry: %s", stripErr))
+			}
+			f.dropConn(conn)
+			f.reconnect()
+			return &ackWaitError{err: ackErr, recovered: recovered}
+		}
 	}
-	_, err = f.conn.Write(f.buf)
 	return
 }
 
+// dropConn clears f.conn if it still holds conn, so the next send() call
+// sees no connection and triggers a reconnect instead of writing to (or
+// reading acks from) a socket already known to be broken.
+func (f *Fluent) dropConn(conn net.Conn) {
+	f.mu.Lock()
+	if f.conn == conn {
+		f.conn = nil
+	}
+	f.mu.Unlock()
+}
+
+// readAck blocks, bounded by Config.Timeout, for the {"ack": chunk}
+// response Fluentd sends once it has durably received the given chunk.
+func (f *Fluent) readAck(conn net.Conn, chunk string) error {
+	if err := conn.SetReadDeadline(time.Now().Add(f.Config.Timeout)); err != nil {
+		return err
+	}
+	resp := &AckResp{}
+	if err := resp.DecodeMsg(msgp.NewReader(conn)); err != nil {
+		return fmt.Errorf("fluent#readAck: failed to read ack: %s", err)
+	}
+	if resp.Ack != chunk {
+		return fmt.Errorf("fluent#readAck: ack mismatch, expected %q got %q", chunk, resp.Ack)
+	}
+	return nil
+}
+
+// spooler pushes every payload posted through postCh onto the buffer,
+// from where sender will pick it up.
 func (f *Fluent) spooler(ctx context.Context) {
-	senderResult := make(chan error)
-	sendChCh := f.sender(ctx, senderResult)
 	for {
 		select {
 		case data := <-f.postCh:
-			f.buf = append(f.buf, data...)
-			if len(f.buf) > f.Config.BufferLimit {
-				f.flushBuffer()
+			if _, err := f.buffer.Push(data); err != nil {
+				f.notifyError(fmt.Errorf("fluent#spooler: %s", err))
 			}
-		case sendCh := <-sendChCh:
-			var buf []byte
-			copy(buf, f.buf)
-			f.flushBuffer()
-			sendCh <- buf
 		case <-ctx.Done():
-			<-senderResult
-			f.send(f.buf)
-			f.flushBuffer()
-			f.close()
 			return
 		}
 	}
 }
-func (f *Fluent) sender(ctx context.Context, result chan error) chan chan []byte {
-	sendCh := make(chan chan []byte)
-	go func() {
-		bufCh := make(chan []byte)
-		for {
-			sendCh <- bufCh
+
+// sender continuously pops the oldest buffered payload and sends it,
+// acking it only once delivery succeeds. A payload that fails to send is
+// requeued so a later attempt (against a freshly reconnected conn) can
+// pick it up.
+func (f *Fluent) sender(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		id, data, ok := f.buffer.Pop()
+		if !ok {
 			select {
-			case data := <-bufCh:
-				f.send(data)
+			case <-time.After(senderPollInterval):
 			case <-ctx.Done():
-				result <- ctx.Err()
 				return
 			}
+			continue
 		}
-	}()
-	return sendCh
+
+		// RequestAck payloads carry their chunk id in the encoded option
+		// map; recover it here so send waits for the ack even though this
+		// payload went through the buffer instead of being sent directly.
+		// Only bother decoding when RequestAck is actually in use: plain
+		// posts (the common case) skip the decode entirely, and so does a
+		// PostRawData caller whose payload was never a Message to begin
+		// with.
+		var chunk string
+		if f.Config.RequestAck {
+			var chunkErr error
+			chunk, chunkErr = extractChunk(data)
+			if chunkErr != nil {
+				f.notifyError(fmt.Errorf("fluent#sender: failed to read chunk option: %s", chunkErr))
+			}
+		}
+
+		if err := f.send(data, chunk); err != nil {
+			f.notifyError(fmt.Errorf("fluent#sender: failed to send buffered payload: %s", err))
+			var ackErr *ackWaitError
+			if errors.As(err, &ackErr) && ackErr.recovered {
+				// send already re-enqueued a stripped retry for this
+				// ack-wait failure, so the original is done for -- ack it
+				// here (a no-op for memoryBuffer, but it frees fileBuffer's
+				// backing chunk file) rather than leaving it to leak.
+				if ackErr2 := f.buffer.Ack(id); ackErr2 != nil {
+					f.notifyError(fmt.Errorf("fluent#sender: failed to ack superseded payload: %s", ackErr2))
+				}
+			} else {
+				// Anything else (no connection, write failure, or an
+				// ack-wait failure whose own retry never made it into the
+				// buffer): the original is still the only copy, so put it
+				// back for the next Pop to retry rather than losing it.
+				f.buffer.Requeue(id, data)
+			}
+			select {
+			case <-time.After(senderPollInterval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		if err := f.buffer.Ack(id); err != nil {
+			f.notifyError(fmt.Errorf("fluent#sender: failed to ack delivered payload: %s", err))
+		}
+	}
 }
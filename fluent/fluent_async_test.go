@@ -0,0 +1,42 @@
+package fluent
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAsyncConnect_ReturnsImmediatelyAndSurfacesErrors checks that New
+// doesn't block dialing an unreachable host when AsyncConnect is set, and
+// that a permanently failed reconnect surfaces on Errors() instead of
+// panicking.
+func TestAsyncConnect_ReturnsImmediatelyAndSurfacesErrors(t *testing.T) {
+	start := time.Now()
+	f, err := New(Config{
+		FluentHost: "127.0.0.1", FluentPort: 1, // nothing listens here
+		AsyncConnect:       true,
+		ForceStopAsyncSend: true,
+		RetryWait:          10,
+		MaxRetry:           2,
+	})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer f.Close()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("New with AsyncConnect took %s, expected it to return immediately", elapsed)
+	}
+
+	if err := f.Post("app.buffered", map[string]string{"k": "v"}); err != nil {
+		t.Errorf("Post against an unreachable host should buffer rather than error: %s", err)
+	}
+
+	select {
+	case bgErr := <-f.Errors():
+		if bgErr == nil {
+			t.Error("expected a non-nil background error")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the failed reconnect to surface on Errors()")
+	}
+}
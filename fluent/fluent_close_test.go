@@ -0,0 +1,82 @@
+package fluent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardServer accepts connections and reads (and discards) whatever is
+// written to them, so posts racing Close have somewhere to land.
+func discardServer(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			buf := make([]byte, 4096)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// TestConcurrentPostAndClose stress-tests Post racing Close: neither
+// should panic, and Post must start returning ErrClosed (never block or
+// crash) once Close has been called.
+func TestConcurrentPostAndClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+	go discardServer(ln)
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	var port int
+	fmt.Sscanf(portStr, "%d", &port)
+
+	f, err := New(Config{FluentHost: host, FluentPort: port})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	const workers = 50
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = f.Post("app.stress", map[string]int{"i": i, "j": j})
+			}
+		}(i)
+	}
+
+	// Close while posts are still in flight.
+	time.Sleep(5 * time.Millisecond)
+	closeDone := make(chan error, 1)
+	go func() { closeDone <- f.Close() }()
+
+	select {
+	case err := <-closeDone:
+		if err != nil {
+			t.Errorf("Close returned an error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return in time")
+	}
+
+	wg.Wait()
+
+	if err := f.Post("app.too-late", map[string]string{"k": "v"}); err != ErrClosed {
+		t.Errorf("Post after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,45 @@
+package fluent
+
+// Message is the tuple sent over the Forward protocol: [tag, time, record]
+// normally, or [tag, time, record, option] when Option is attached (e.g.
+// "chunk" for ack handling). Its msgp codec in message_gen.go is
+// hand-written rather than msgp-generated, since msgp's tuple encoding has
+// no notion of a conditionally-present trailing element -- encoding a
+// 4-element array unconditionally would be a wire-format break for every
+// consumer of this package, not just RequestAck users.
+type Message struct {
+	Tag    string
+	Time   interface{}
+	Record interface{}
+	Option interface{}
+}
+
+// stripOption decodes an already-encoded Message and re-encodes it with
+// Option cleared. It's used to retry a payload that failed its ack wait
+// through the generic buffer, where it will be sent without requesting a
+// new ack -- so it must no longer carry the old chunk id either.
+func stripOption(data []byte) ([]byte, error) {
+	var msg Message
+	if _, err := msg.UnmarshalMsg(data); err != nil {
+		return nil, err
+	}
+	msg.Option = nil
+	return msg.MarshalMsg(nil)
+}
+
+// extractChunk decodes an already-encoded Message and returns the chunk id
+// from its option map, if any. It's used by sender to recover the chunk id
+// a RequestAck payload was encoded with once it comes back out of the
+// generic buffer, so sender knows to wait for an ack on it.
+func extractChunk(data []byte) (string, error) {
+	var msg Message
+	if _, err := msg.UnmarshalMsg(data); err != nil {
+		return "", err
+	}
+	opt, ok := msg.Option.(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+	chunk, _ := opt["chunk"].(string)
+	return chunk, nil
+}
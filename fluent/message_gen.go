@@ -0,0 +1,145 @@
+package fluent
+
+// Message's msgp codec is hand-written, not generated: it encodes as a
+// 3-element array ([tag, time, record]) when Option is nil, and a
+// 4-element array ([tag, time, record, option]) otherwise, matching the
+// wire format Fluentd expects in each case.
+
+import (
+	"github.com/tinylib/msgp/msgp"
+)
+
+// DecodeMsg implements msgp.Decodable
+func (z *Message) DecodeMsg(dc *msgp.Reader) (err error) {
+	var zb0001 uint32
+	zb0001, err = dc.ReadArrayHeader()
+	if err != nil {
+		return
+	}
+	if zb0001 != 3 && zb0001 != 4 {
+		err = msgp.ArrayError{Wanted: 4, Got: zb0001}
+		return
+	}
+	z.Tag, err = dc.ReadString()
+	if err != nil {
+		return
+	}
+	z.Time, err = dc.ReadIntf()
+	if err != nil {
+		return
+	}
+	z.Record, err = dc.ReadIntf()
+	if err != nil {
+		return
+	}
+	if zb0001 == 4 {
+		z.Option, err = dc.ReadIntf()
+		if err != nil {
+			return
+		}
+	} else {
+		z.Option = nil
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *Message) EncodeMsg(en *msgp.Writer) (err error) {
+	if z.Option == nil {
+		err = en.WriteArrayHeader(3)
+	} else {
+		err = en.WriteArrayHeader(4)
+	}
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Tag)
+	if err != nil {
+		return
+	}
+	err = en.WriteIntf(z.Time)
+	if err != nil {
+		return
+	}
+	err = en.WriteIntf(z.Record)
+	if err != nil {
+		return
+	}
+	if z.Option != nil {
+		err = en.WriteIntf(z.Option)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *Message) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	if z.Option == nil {
+		o = msgp.AppendArrayHeader(o, 3)
+	} else {
+		o = msgp.AppendArrayHeader(o, 4)
+	}
+	o = msgp.AppendString(o, z.Tag)
+	o, err = msgp.AppendIntf(o, z.Time)
+	if err != nil {
+		return
+	}
+	o, err = msgp.AppendIntf(o, z.Record)
+	if err != nil {
+		return
+	}
+	if z.Option != nil {
+		o, err = msgp.AppendIntf(o, z.Option)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *Message) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadArrayHeaderBytes(bts)
+	if err != nil {
+		return
+	}
+	if zb0001 != 3 && zb0001 != 4 {
+		err = msgp.ArrayError{Wanted: 4, Got: zb0001}
+		return
+	}
+	z.Tag, bts, err = msgp.ReadStringBytes(bts)
+	if err != nil {
+		return
+	}
+	z.Time, bts, err = msgp.ReadIntfBytes(bts)
+	if err != nil {
+		return
+	}
+	z.Record, bts, err = msgp.ReadIntfBytes(bts)
+	if err != nil {
+		return
+	}
+	if zb0001 == 4 {
+		z.Option, bts, err = msgp.ReadIntfBytes(bts)
+		if err != nil {
+			return
+		}
+	} else {
+		z.Option = nil
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *Message) Msgsize() (s int) {
+	s = 1 + msgp.StringPrefixSize + len(z.Tag) + msgp.GuessSize(z.Time) + msgp.GuessSize(z.Record)
+	if z.Option != nil {
+		s += msgp.GuessSize(z.Option)
+	}
+	return
+}